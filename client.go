@@ -0,0 +1,207 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Dialer dials a WebSocket server, optionally offering a
+// CompressionExtension such as permessage-deflate.
+type Dialer struct {
+	// NetDial, if non-nil, is used to dial the underlying network
+	// connection instead of net.Dial. Only used for ws:// URLs.
+	NetDial func(network, addr string) (net.Conn, error)
+
+	// EnableCompression specifies whether the client should offer a
+	// CompressionExtension to the server. It defaults to false.
+	EnableCompression bool
+
+	// EnableContextTakeover specifies whether the client is willing to
+	// negotiate permessage-deflate context takeover (retaining the LZ77
+	// dictionary across messages) in either direction. It defaults to
+	// false, which offers client_no_context_takeover and
+	// server_no_context_takeover unconditionally.
+	EnableContextTakeover bool
+
+	// ServerMaxWindowBits, if in the range 8-15, caps the LZ77 window the
+	// server's writer may use; the client's reader enforces this bound, so
+	// it is offered as server_max_window_bits. 0 leaves the server's window
+	// uncapped.
+	ServerMaxWindowBits int
+
+	// ClientMaxWindowBits has no effect: it would cap the client's own
+	// writer window, which compress/flate cannot actually restrict, so it
+	// is never offered as client_max_window_bits. It exists so Dialer's
+	// negotiation fields mirror Upgrader's.
+	ClientMaxWindowBits int
+
+	// MaxDecompressedMessageSize bounds the decompressed size of a single
+	// message on a connection that negotiated a CompressionExtension; 0
+	// means unlimited. See ErrDecompressedMessageTooLarge.
+	MaxDecompressedMessageSize int64
+
+	// MaxCompressionRatio bounds decompressed-size / compressed-size for a
+	// single message; 0 means unlimited.
+	MaxCompressionRatio float64
+
+	// ReadLimit bounds a single frame's raw payload length, read off the
+	// wire before any decompression; 0 means unlimited. See
+	// Conn.SetReadLimit.
+	ReadLimit int64
+
+	extensions compressionExtensionRegistry
+}
+
+// RegisterCompressionExtension installs ext so it can be offered to the
+// server on connections this Dialer dials, in addition to the default
+// permessage-deflate. Extensions are offered in the order registered.
+func (d *Dialer) RegisterCompressionExtension(ext CompressionExtension) {
+	d.extensions.register(ext)
+}
+
+// compressionOffer returns the Sec-WebSocket-Extensions request header
+// value to send, or "" if compression is disabled.
+func (d *Dialer) compressionOffer() string {
+	if !d.EnableCompression {
+		return ""
+	}
+	d.extensions.ensureDefault(&permessageDeflateExtension{
+		level:                      defaultCompressionLevel,
+		isServer:                   false,
+		enableContextTakeover:      d.EnableContextTakeover,
+		clientMaxWindowBits:        d.ClientMaxWindowBits,
+		serverMaxWindowBits:        d.ServerMaxWindowBits,
+		maxDecompressedMessageSize: d.MaxDecompressedMessageSize,
+		maxCompressionRatio:        d.MaxCompressionRatio,
+	})
+
+	var offers []string
+	for _, ext := range d.extensions.list() {
+		offers = append(offers, ext.NegotiateClient())
+	}
+	return strings.Join(offers, ", ")
+}
+
+// acceptExtension parses the server's Sec-WebSocket-Extensions response and
+// returns the ConnExtension to use for the connection, or nil if the server
+// didn't accept an extension.
+func (d *Dialer) acceptExtension(header string) ConnExtension {
+	if header == "" {
+		return nil
+	}
+	name := extensionToken(header)
+	for _, candidate := range d.extensions.list() {
+		if candidate.Name() != name {
+			continue
+		}
+		if ext, err := candidate.NegotiateClientAccept(header); err == nil {
+			return ext
+		}
+	}
+	return nil
+}
+
+// Dial creates a new client connection to urlStr, which must use the ws or
+// wss scheme. requestHeader, if non-nil, is merged into the handshake
+// request.
+func (d *Dialer) Dial(urlStr string, requestHeader http.Header) (*Conn, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	var port string
+	switch u.Scheme {
+	case "ws":
+		port = "80"
+	case "wss":
+		port = "443"
+	default:
+		return nil, errors.New("websocket: unsupported scheme " + u.Scheme)
+	}
+	if p := u.Port(); p != "" {
+		port = p
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	var netConn net.Conn
+	if u.Scheme == "wss" {
+		netConn, err = tls.Dial("tcp", addr, nil)
+	} else {
+		netDial := d.NetDial
+		if netDial == nil {
+			netDial = net.Dial
+		}
+		netConn, err = netDial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := generateChallengeKey()
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	offer := d.compressionOffer()
+
+	var buf strings.Builder
+	buf.WriteString("GET " + u.RequestURI() + " HTTP/1.1\r\n")
+	buf.WriteString("Host: " + u.Host + "\r\n")
+	buf.WriteString("Upgrade: websocket\r\n")
+	buf.WriteString("Connection: Upgrade\r\n")
+	buf.WriteString("Sec-WebSocket-Key: " + key + "\r\n")
+	buf.WriteString("Sec-WebSocket-Version: 13\r\n")
+	if offer != "" {
+		buf.WriteString("Sec-WebSocket-Extensions: " + offer + "\r\n")
+	}
+	for k, vs := range requestHeader {
+		for _, v := range vs {
+			buf.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+
+	if _, err := netConn.Write([]byte(buf.String())); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "GET"})
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		netConn.Close()
+		return nil, errors.New("websocket: bad handshake: " + resp.Status)
+	}
+
+	extension := d.acceptExtension(resp.Header.Get("Sec-WebSocket-Extensions"))
+
+	return newConn(netConn, false, br, extension, d.ReadLimit), nil
+}
+
+// generateChallengeKey returns a new random Sec-WebSocket-Key value, per
+// RFC 6455 section 4.1.
+func generateChallengeKey() (string, error) {
+	var p [16]byte
+	if _, err := io.ReadFull(rand.Reader, p[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(p[:]), nil
+}
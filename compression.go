@@ -18,6 +18,14 @@ const (
 	maxCompressionLevel     = flate.BestCompression
 	defaultCompressionLevel = 1
 
+	// minWindowBits and maxWindowBits are the smallest and largest
+	// server_max_window_bits / client_max_window_bits values that
+	// permessage-deflate (RFC 7692 7.1.2) allows peers to negotiate.
+	// maxWindowBits also doubles as compress/flate's fixed 32 KiB window
+	// size (1<<15), since flate provides no way to shrink it.
+	minWindowBits = 8
+	maxWindowBits = 15
+
 	tail =
 	// Add four bytes as specified in RFC
 	"\x00\x00\xff\xff" +
@@ -32,16 +40,85 @@ var (
 	}}
 )
 
-func decompressNoContextTakeover(r io.Reader) io.ReadCloser {
+// ErrDecompressedMessageTooLarge is returned by a compressed message reader
+// once the decompressed output has exceeded the connection's configured
+// MaxDecompressedMessageSize or MaxCompressionRatio. It protects against
+// decompression-bomb frames that are small on the wire but expand to
+// exhaust memory. Conn.NextReader sends a close frame with status code 1009
+// (message too big) before returning it.
+var ErrDecompressedMessageTooLarge = errors.New("websocket: decompressed message too large")
+
+// decompressLimiter bounds a single compressed WebSocket message by
+// counting the compressed bytes read off the wire against the decompressed
+// bytes handed back to the caller, rejecting the message with
+// ErrDecompressedMessageTooLarge as soon as either MaxDecompressedMessageSize
+// or MaxCompressionRatio is exceeded. It is checked independently of
+// ReadLimit, which only bounds the compressed frame itself.
+type decompressLimiter struct {
+	maxSize  int64   // 0 disables the absolute size check
+	maxRatio float64 // 0 disables the ratio check
+
+	in  int64
+	out int64
+}
+
+// reset clears the byte counters at the start of a message. maxSize and
+// maxRatio are left untouched so the limiter can be reused across messages
+// on a context-takeover connection.
+func (l *decompressLimiter) reset() {
+	l.in = 0
+	l.out = 0
+}
+
+// countInput wraps r so that bytes read through it are counted as
+// compressed input for the ratio check.
+func (l *decompressLimiter) countInput(r io.Reader) io.Reader {
+	return &limiterCountingReader{r: r, l: l}
+}
+
+// checkOutput records n additional decompressed bytes and reports
+// ErrDecompressedMessageTooLarge if doing so breaches maxSize or maxRatio.
+func (l *decompressLimiter) checkOutput(n int) error {
+	l.out += int64(n)
+	if l.maxSize > 0 && l.out > l.maxSize {
+		return ErrDecompressedMessageTooLarge
+	}
+	if l.maxRatio > 0 && l.in > 0 && float64(l.out) > l.maxRatio*float64(l.in) {
+		return ErrDecompressedMessageTooLarge
+	}
+	return nil
+}
+
+type limiterCountingReader struct {
+	r io.Reader
+	l *decompressLimiter
+}
+
+func (c *limiterCountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.l.in += int64(n)
+	return n, err
+}
+
+func decompressNoContextTakeover(r io.Reader, maxSize int64, maxRatio float64) io.ReadCloser {
 	fr, _ := flateReaderPool.Get().(io.ReadCloser)
-	fr.(flate.Resetter).Reset(io.MultiReader(r, strings.NewReader(tail)), nil)
-	return &flateReadWrapper{fr: fr}
+	limiter := &decompressLimiter{maxSize: maxSize, maxRatio: maxRatio}
+	fr.(flate.Resetter).Reset(io.MultiReader(limiter.countInput(r), strings.NewReader(tail)), nil)
+	return &flateReadWrapper{fr: fr, limiter: limiter}
 }
 
 func isValidCompressionLevel(level int) bool {
 	return minCompressionLevel <= level && level <= maxCompressionLevel
 }
 
+// isValidWindowBits reports whether bits is an acceptable value for a
+// negotiated server_max_window_bits or client_max_window_bits extension
+// parameter. Zero is accepted as shorthand for "not negotiated", in which
+// case the implementation falls back to the full maxWindowBits window.
+func isValidWindowBits(bits int) bool {
+	return bits == 0 || (minWindowBits <= bits && bits <= maxWindowBits)
+}
+
 func compressNoContextTakeover(w io.WriteCloser, level int) io.WriteCloser {
 	p := &flateWriterPools[level-minCompressionLevel]
 	tw := &truncWriter{w: w}
@@ -129,7 +206,8 @@ func (w *flateWriteWrapper) Close() error {
 }
 
 type flateReadWrapper struct {
-	fr io.ReadCloser
+	fr      io.ReadCloser
+	limiter *decompressLimiter
 }
 
 func (r *flateReadWrapper) Read(p []byte) (int, error) {
@@ -139,6 +217,13 @@ func (r *flateReadWrapper) Read(p []byte) (int, error) {
 
 	n, err := r.fr.Read(p)
 
+	if err == nil || err == io.EOF {
+		if lerr := r.limiter.checkOutput(n); lerr != nil {
+			r.Close()
+			return n, lerr
+		}
+	}
+
 	if err == io.EOF {
 		// Preemptively place the reader back in the pool. This helps with
 		// scenarios where the application does not call NextReader() soon after
@@ -162,6 +247,19 @@ func (r *flateReadWrapper) Close() error {
 }
 
 type (
+	// contextTakeoverWriterFactory produces compressors for a single
+	// connection that has negotiated permessage-deflate without
+	// client_no_context_takeover / server_no_context_takeover. fw is
+	// allocated once and reused (never Reset) for the lifetime of the
+	// connection so that later messages can back-reference the LZ77
+	// window built up by earlier ones, as required by RFC 7692 7.2.1.
+	// contextTakeoverWriterFactory always compresses with the full
+	// maxWindowBits LZ77 window: compress/flate has no way to shrink a
+	// Writer's window, so unlike contextTakeoverReaderFactory there is no
+	// windowBits field here to narrow. A negotiated *_max_window_bits that
+	// would require restricting our own writer is declined during
+	// extension negotiation instead of being recorded and ignored; see
+	// permessageDeflateExtension.NegotiateServer.
 	contextTakeoverWriterFactory struct {
 		fw *flate.Writer
 		tw truncWriter
@@ -175,6 +273,14 @@ type (
 func (f *contextTakeoverWriterFactory) newCompressionWriter(w io.WriteCloser, level int) io.WriteCloser {
 	f.tw.w = w
 	f.tw.n = 0
+	if f.fw == nil {
+		// First message on this connection: allocate the flate.Writer and
+		// retain it across messages instead of returning a fresh one each
+		// time, so its LZ77 dictionary carries forward. Later calls reuse
+		// fw and only repoint the truncWriter at the current frame.
+		fw, _ := flate.NewWriter(&f.tw, level)
+		f.fw = fw
+	}
 	return &flateTakeoverWriteWrapper{f}
 }
 
@@ -203,9 +309,27 @@ func (w *flateTakeoverWriteWrapper) Close() error {
 }
 
 type (
+	// contextTakeoverReaderFactory produces decompressors for a single
+	// connection that has negotiated permessage-deflate without
+	// client_no_context_takeover / server_no_context_takeover. window
+	// accumulates the bytes produced across messages and is supplied back
+	// to flate as a preset LZ77 dictionary so that back-references made
+	// by the peer's context-taking-over writer can be resolved.
 	contextTakeoverReaderFactory struct {
 		fr     io.ReadCloser
 		window []byte
+
+		// windowBits is the negotiated window size for this side of the
+		// connection; window is trimmed to 1<<windowBits bytes. Zero means
+		// no window bits were negotiated, so the full maxWindowBits window
+		// applies.
+		windowBits int
+
+		// limiter enforces MaxDecompressedMessageSize / MaxCompressionRatio
+		// across every message on this connection. Its maxSize and maxRatio
+		// are set once when the factory is created; newDeCompressionReader
+		// resets its byte counters at the start of each message.
+		limiter decompressLimiter
 	}
 
 	flateTakeoverReadWrapper struct {
@@ -213,8 +337,19 @@ type (
 	}
 )
 
+// maxWindowSize returns the negotiated dictionary size in bytes for f,
+// falling back to the full maxWindowBits window when none was negotiated.
+func (f *contextTakeoverReaderFactory) maxWindowSize() int {
+	bits := f.windowBits
+	if bits == 0 {
+		bits = maxWindowBits
+	}
+	return 1 << uint(bits)
+}
+
 func (f *contextTakeoverReaderFactory) newDeCompressionReader(r io.Reader) io.ReadCloser {
-	f.fr.(flate.Resetter).Reset(io.MultiReader(r, strings.NewReader(tail)), f.window)
+	f.limiter.reset()
+	f.fr.(flate.Resetter).Reset(io.MultiReader(f.limiter.countInput(r), strings.NewReader(tail)), f.window)
 	return &flateTakeoverReadWrapper{f}
 }
 
@@ -225,13 +360,22 @@ func (r *flateTakeoverReadWrapper) Read(p []byte) (int, error) {
 
 	n, err := r.f.fr.Read(p)
 
-	// add window
+	// Grow the preset dictionary with the bytes we just produced, capped to
+	// the negotiated window size, so the next message's Reset call can
+	// back-reference them (RFC 7692 7.2.2).
 	r.f.window = append(r.f.window, p[:n]...)
-	if len(r.f.window) > maxWindowBits {
-		offset := len(r.f.window) - maxWindowBits
+	if max := r.f.maxWindowSize(); len(r.f.window) > max {
+		offset := len(r.f.window) - max
 		r.f.window = r.f.window[offset:]
 	}
 
+	if err == nil || err == io.EOF {
+		if lerr := r.f.limiter.checkOutput(n); lerr != nil {
+			r.Close()
+			return n, lerr
+		}
+	}
+
 	if err == io.EOF {
 		// Preemptively place the reader back in the pool. This helps with
 		// scenarios where the application does not call NextReader() soon after
@@ -0,0 +1,371 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ConnExtension is the per-connection half of a negotiated
+// CompressionExtension. One ConnExtension is created per connection, and
+// its NewReader and NewWriter are called once per message, so an extension
+// that needs context-takeover state, like permessage-deflate, can keep it in
+// the ConnExtension for the connection's lifetime.
+type ConnExtension interface {
+	// NewReader wraps r, the reader for a single message's payload, in a
+	// decompressing io.ReadCloser.
+	NewReader(r io.Reader) io.ReadCloser
+
+	// NewWriter wraps w, the writer for a single message's payload, in a
+	// compressing io.WriteCloser. The returned writer's Close ends the
+	// message but must not close w itself more than once.
+	NewWriter(w io.WriteCloser) io.WriteCloser
+}
+
+// CompressionExtension is a WebSocket extension negotiated over
+// Sec-WebSocket-Extensions that transforms message payloads, such as
+// permessage-deflate (RFC 7692). Implementations are installed with
+// Upgrader.RegisterCompressionExtension / Dialer.RegisterCompressionExtension,
+// which both delegate to compressionExtensionRegistry.register below, so a
+// single Upgrader or Dialer can serve mixed client populations (e.g.
+// permessage-deflate and permessage-brotli side by side).
+type CompressionExtension interface {
+	// Name is the extension-token this extension negotiates under, e.g.
+	// "permessage-deflate".
+	Name() string
+
+	// NegotiateServer is called with one of the client's offered
+	// Sec-WebSocket-Extensions offers whose token matches Name. On success
+	// it returns the extension string to echo back in the 101 response and
+	// the ConnExtension to use for the connection. A non-nil error declines
+	// this offer; the registry then tries the client's next offer, if any.
+	NegotiateServer(offer string) (accept string, ext ConnExtension, err error)
+
+	// NegotiateClient returns the offer this extension sends in the
+	// client's Sec-WebSocket-Extensions request header.
+	NegotiateClient() (offer string)
+
+	// NegotiateClientAccept is called on the Dialer side with the server's
+	// Sec-WebSocket-Extensions accept string, taken from its 101 response to
+	// the offer this same extension produced from NegotiateClient. It
+	// returns the ConnExtension to use for the connection. An offer's and an
+	// accept's parameter grammars are not guaranteed to be symmetric, so
+	// implementations must not reuse NegotiateServer to parse an accept.
+	NegotiateClientAccept(accept string) (ext ConnExtension, err error)
+}
+
+// compressionExtensionRegistry holds the CompressionExtensions an Upgrader or
+// Dialer will negotiate, in registration order. The zero value negotiates
+// only permessage-deflate, the extension this package has always supported.
+type compressionExtensionRegistry struct {
+	mu         sync.Mutex
+	extensions []CompressionExtension
+
+	// hasDefault records that ensureDefault has already added its default.
+	hasDefault bool
+}
+
+// register appends ext to the registry. The client's offer order decides
+// which extension is negotiated; registration order only decides between
+// registered extensions that share the offered extension's name, where the
+// first one registered wins.
+func (reg *compressionExtensionRegistry) register(ext CompressionExtension) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.extensions = append(reg.extensions, ext)
+}
+
+// list returns the registered extensions.
+func (reg *compressionExtensionRegistry) list() []CompressionExtension {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.extensions
+}
+
+// ensureDefault appends def to the registry the first time it is called and
+// does nothing on later calls, so the default is negotiated alongside any
+// extensions registered with register. Upgrader and Dialer each call this
+// with their own permessageDeflateExtension, configured with that
+// Upgrader/Dialer's own
+// options (decompression limits, its role in the handshake), instead of
+// sharing one global default instance across unrelated connections.
+func (reg *compressionExtensionRegistry) ensureDefault(def CompressionExtension) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if !reg.hasDefault {
+		reg.extensions = append(reg.extensions, def)
+		reg.hasDefault = true
+	}
+}
+
+// negotiateServer walks the client's offered extensions in order and
+// returns the accept string and ConnExtension for the first offer any
+// registered CompressionExtension accepts. It returns a nil ext if none of
+// the offers could be negotiated.
+func (reg *compressionExtensionRegistry) negotiateServer(offers []string) (accept string, ext ConnExtension) {
+	for _, offer := range offers {
+		name := extensionToken(offer)
+		for _, candidate := range reg.list() {
+			if candidate.Name() != name {
+				continue
+			}
+			if a, e, err := candidate.NegotiateServer(offer); err == nil {
+				return a, e
+			}
+		}
+	}
+	return "", nil
+}
+
+// extensionToken returns the extension-token prefix of a single
+// Sec-WebSocket-Extensions offer, e.g. "permessage-deflate" from
+// "permessage-deflate; client_no_context_takeover".
+func extensionToken(offer string) string {
+	if i := strings.IndexByte(offer, ';'); i >= 0 {
+		offer = offer[:i]
+	}
+	return strings.TrimSpace(offer)
+}
+
+// extensionParams is a parsed Sec-WebSocket-Extensions offer or accept
+// string, keyed by parameter name, e.g. parsing "permessage-deflate;
+// client_no_context_takeover; server_max_window_bits=10" yields
+// {"client_no_context_takeover": "", "server_max_window_bits": "10"}.
+type extensionParams map[string]string
+
+func parseExtensionParams(offer string) extensionParams {
+	params := extensionParams{}
+	parts := strings.Split(offer, ";")
+	for _, part := range parts[1:] { // parts[0] is the extension token itself
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			key := strings.TrimSpace(part[:i])
+			value := strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+			params[key] = value
+		} else {
+			params[part] = ""
+		}
+	}
+	return params
+}
+
+func (p extensionParams) has(key string) bool {
+	_, ok := p[key]
+	return ok
+}
+
+// windowBits returns the negotiated value of a *_max_window_bits parameter,
+// or 0 if it was not present. It returns an error if the parameter is
+// present but not a valid window bits value (8-15).
+func (p extensionParams) windowBits(key string) (int, error) {
+	v, ok := p[key]
+	if !ok || v == "" {
+		return 0, nil
+	}
+	bits, err := strconv.Atoi(v)
+	if err != nil || !isValidWindowBits(bits) {
+		return 0, fmt.Errorf("websocket: invalid %s value %q", key, v)
+	}
+	return bits, nil
+}
+
+// permessageDeflateExtension implements permessage-deflate (RFC 7692) as a
+// CompressionExtension, wrapping the compress/decompress helpers in
+// compression.go. Upgrader and Dialer each construct their own instance
+// (via compressionExtensionRegistry.ensureDefault) configured with their own
+// decompression limits, isServer, and the negotiation policy from their own
+// EnableContextTakeover/ClientMaxWindowBits/ServerMaxWindowBits fields,
+// rather than sharing one global default across unrelated connections.
+type permessageDeflateExtension struct {
+	level    int
+	isServer bool
+
+	// enableContextTakeover is this side's policy for whether it is willing
+	// to use context takeover at all; false declines it for both writer
+	// directions regardless of what the peer asks for.
+	enableContextTakeover bool
+
+	// clientMaxWindowBits and serverMaxWindowBits are this side's values for
+	// the wire parameters of the same name: the cap this side wants to see
+	// on the client's, resp. the server's, writer window. Only the value
+	// naming the *peer's* writer (client_max_window_bits for a server,
+	// server_max_window_bits for a client) can actually be enforced, since
+	// it bounds what this side's reader asks the peer to respect; the value
+	// naming this side's own writer is never sent, for the same reason
+	// NegotiateServer never echoes it back, below.
+	clientMaxWindowBits int
+	serverMaxWindowBits int
+
+	maxDecompressedMessageSize int64
+	maxCompressionRatio        float64
+}
+
+func (e *permessageDeflateExtension) Name() string { return "permessage-deflate" }
+
+// NegotiateClient builds the Sec-WebSocket-Extensions offer a Dialer sends,
+// from e.enableContextTakeover and e.serverMaxWindowBits. e.clientMaxWindowBits
+// is deliberately never offered: it would ask the server to trust a bound on
+// our own writer that compress/flate can't actually enforce.
+func (e *permessageDeflateExtension) NegotiateClient() string {
+	offer := "permessage-deflate"
+	if !e.enableContextTakeover {
+		offer += "; client_no_context_takeover; server_no_context_takeover"
+	}
+	if e.serverMaxWindowBits != 0 && isValidWindowBits(e.serverMaxWindowBits) {
+		offer += fmt.Sprintf("; server_max_window_bits=%d", e.serverMaxWindowBits)
+	}
+	return offer
+}
+
+// parseWireParams parses a Sec-WebSocket-Extensions parameter string
+// (either a client offer or a server accept) for permessage-deflate, role-
+// aware via e.isServer: myTakeoverParam/peerTakeoverParam name the wire
+// parameter that restricts this side's writer, resp. the peer's writer, and
+// peerWindowBitsParam the one that caps the peer's writer window, flipped
+// for a client vs. a server. proactive is true only when generating an accept as
+// the server, where RFC 7692 7.1.2.2 permits tightening, or proactively
+// introducing, a cap on the peer's writer window beyond what it offered;
+// when parsing an accept as the client, peerBits must be exactly what the
+// server granted, not ours to invent.
+func (e *permessageDeflateExtension) parseWireParams(s string, proactive bool) (myTakeover, peerTakeover bool, peerBits int, err error) {
+	params := parseExtensionParams(s)
+
+	myTakeoverParam, peerTakeoverParam := "server_no_context_takeover", "client_no_context_takeover"
+	peerWindowBitsParam := "client_max_window_bits"
+	peerRequestBits := e.clientMaxWindowBits
+	if !e.isServer {
+		myTakeoverParam, peerTakeoverParam = peerTakeoverParam, myTakeoverParam
+		peerWindowBitsParam = "server_max_window_bits"
+		peerRequestBits = e.serverMaxWindowBits
+	}
+
+	myTakeover = e.enableContextTakeover && !params.has(myTakeoverParam)
+	peerTakeover = e.enableContextTakeover && !params.has(peerTakeoverParam)
+
+	peerBits, err = params.windowBits(peerWindowBitsParam)
+	if err != nil {
+		return false, false, 0, err
+	}
+	if proactive && peerRequestBits != 0 && isValidWindowBits(peerRequestBits) && (peerBits == 0 || peerRequestBits < peerBits) {
+		peerBits = peerRequestBits
+	}
+	return myTakeover, peerTakeover, peerBits, nil
+}
+
+// NegotiateServer parses one of the client's offers for permessage-deflate
+// and returns the accept string and ConnExtension for it.
+func (e *permessageDeflateExtension) NegotiateServer(offer string) (string, ConnExtension, error) {
+	myTakeover, peerTakeover, peerBits, err := e.parseWireParams(offer, true)
+	if err != nil {
+		return "", nil, err
+	}
+
+	accept := "permessage-deflate"
+	if !myTakeover {
+		accept += "; server_no_context_takeover"
+	}
+	if !peerTakeover {
+		accept += "; client_no_context_takeover"
+	}
+	if peerBits != 0 {
+		accept += fmt.Sprintf("; client_max_window_bits=%d", peerBits)
+	}
+	// server_max_window_bits, if offered, is deliberately never echoed back:
+	// compress/flate cannot shrink our own writer's LZ77 window below the
+	// full maxWindowBits, so accepting it would promise the peer a
+	// restriction we can't actually honor. Declining it (by omission) just
+	// means our writer keeps using the full window, which RFC 7692 permits.
+
+	return accept, &deflateConnExtension{
+		level:                      e.level,
+		myTakeover:                 myTakeover,
+		peerTakeover:               peerTakeover,
+		peerWindowBits:             peerBits,
+		maxDecompressedMessageSize: e.maxDecompressedMessageSize,
+		maxCompressionRatio:        e.maxCompressionRatio,
+	}, nil
+}
+
+// NegotiateClientAccept parses the server's accept string for
+// permessage-deflate, responding to the offer NegotiateClient produced, and
+// returns the ConnExtension for it.
+func (e *permessageDeflateExtension) NegotiateClientAccept(accept string) (ConnExtension, error) {
+	myTakeover, peerTakeover, peerBits, err := e.parseWireParams(accept, false)
+	if err != nil {
+		return nil, err
+	}
+	return &deflateConnExtension{
+		level:                      e.level,
+		myTakeover:                 myTakeover,
+		peerTakeover:               peerTakeover,
+		peerWindowBits:             peerBits,
+		maxDecompressedMessageSize: e.maxDecompressedMessageSize,
+		maxCompressionRatio:        e.maxCompressionRatio,
+	}, nil
+}
+
+// deflateConnExtension is the ConnExtension returned by
+// permessageDeflateExtension. It lazily creates the context-takeover
+// factories from compression.go so a connection that never negotiates
+// context takeover never pays for them.
+type deflateConnExtension struct {
+	level int
+
+	// myTakeover/peerTakeover report whether this side's writer, resp. the
+	// peer's writer (what this side reads), keeps its LZ77 context across
+	// messages.
+	myTakeover   bool
+	peerTakeover bool
+
+	// peerWindowBits is the window size the peer's writer promised to keep
+	// its back-references within, used to size our reader's preset
+	// dictionary; 0 means the peer didn't restrict it (full window). There
+	// is no corresponding "myWindowBits": we never restrict our own
+	// writer's window, see NegotiateServer.
+	peerWindowBits int
+
+	// maxDecompressedMessageSize and maxCompressionRatio bound every
+	// message read through NewReader; both default to 0 (unlimited) unless
+	// the owning Upgrader/Dialer configured otherwise.
+	maxDecompressedMessageSize int64
+	maxCompressionRatio        float64
+
+	readFactory  *contextTakeoverReaderFactory
+	writeFactory *contextTakeoverWriterFactory
+}
+
+func (e *deflateConnExtension) NewReader(r io.Reader) io.ReadCloser {
+	if !e.peerTakeover {
+		return decompressNoContextTakeover(r, e.maxDecompressedMessageSize, e.maxCompressionRatio)
+	}
+	if e.readFactory == nil {
+		e.readFactory = &contextTakeoverReaderFactory{
+			fr:         flateReaderPool.Get().(io.ReadCloser),
+			windowBits: e.peerWindowBits,
+			limiter: decompressLimiter{
+				maxSize:  e.maxDecompressedMessageSize,
+				maxRatio: e.maxCompressionRatio,
+			},
+		}
+	}
+	return e.readFactory.newDeCompressionReader(r)
+}
+
+func (e *deflateConnExtension) NewWriter(w io.WriteCloser) io.WriteCloser {
+	if !e.myTakeover {
+		return compressNoContextTakeover(w, e.level)
+	}
+	if e.writeFactory == nil {
+		e.writeFactory = &contextTakeoverWriterFactory{}
+	}
+	return e.writeFactory.newCompressionWriter(w, e.level)
+}
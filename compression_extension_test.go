@@ -0,0 +1,155 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"io"
+	"testing"
+)
+
+// fakeExtension is a minimal CompressionExtension used to test registry
+// ordering without depending on permessage-deflate. accept, if set,
+// overrides the string NegotiateServer returns, so two fakeExtensions can
+// share the same name yet be told apart by which one actually negotiated.
+type fakeExtension struct {
+	name   string
+	accept string
+}
+
+func (f *fakeExtension) Name() string { return f.name }
+
+func (f *fakeExtension) NegotiateClient() string { return f.name }
+
+func (f *fakeExtension) NegotiateServer(offer string) (string, ConnExtension, error) {
+	if f.accept != "" {
+		return f.accept, fakeConnExtension{}, nil
+	}
+	return f.name, fakeConnExtension{}, nil
+}
+
+func (f *fakeExtension) NegotiateClientAccept(accept string) (ConnExtension, error) {
+	return fakeConnExtension{}, nil
+}
+
+// fakeConnExtension is a no-op ConnExtension; the registry tests only care
+// about which CompressionExtension gets picked, not what it does per
+// connection.
+type fakeConnExtension struct{}
+
+func (fakeConnExtension) NewReader(r io.Reader) io.ReadCloser { return io.NopCloser(r) }
+
+func (fakeConnExtension) NewWriter(w io.WriteCloser) io.WriteCloser { return w }
+
+// TestRegistryNegotiateServerFollowsClientOfferOrder checks that
+// negotiateServer walks the client's offers in the order the client listed
+// them, not registration order: with "permessage-brotli" offered first,
+// it's picked even though "permessage-deflate" was registered first.
+func TestRegistryNegotiateServerFollowsClientOfferOrder(t *testing.T) {
+	var reg compressionExtensionRegistry
+	reg.register(&fakeExtension{name: "permessage-deflate"})
+	reg.register(&fakeExtension{name: "permessage-brotli"})
+
+	accept, ext := reg.negotiateServer([]string{"permessage-brotli", "permessage-deflate"})
+	if ext == nil {
+		t.Fatalf("negotiateServer returned nil ext")
+	}
+	if accept != "permessage-brotli" {
+		t.Fatalf("accept = %q, want %q (client offer order should win over registration order)", accept, "permessage-brotli")
+	}
+}
+
+// TestRegistryNegotiateServerRegistrationOrderIsOnlyATiebreak checks that
+// registration order only decides which candidate wins for a single offer,
+// when more than one registered CompressionExtension shares that offer's
+// name: here two candidates are both named "permessage-deflate", and the
+// one registered first is the one that ends up negotiating.
+func TestRegistryNegotiateServerRegistrationOrderIsOnlyATiebreak(t *testing.T) {
+	var reg compressionExtensionRegistry
+	reg.register(&fakeExtension{name: "permessage-deflate", accept: "first"})
+	reg.register(&fakeExtension{name: "permessage-deflate", accept: "second"})
+
+	accept, ext := reg.negotiateServer([]string{"permessage-deflate"})
+	if ext == nil {
+		t.Fatalf("negotiateServer returned nil ext")
+	}
+	if accept != "first" {
+		t.Fatalf("accept = %q, want %q (first registered match should win)", accept, "first")
+	}
+}
+
+// TestRegistryNegotiateServerSkipsUnregisteredOffers checks that an offer
+// for an extension nobody registered is skipped in favor of a later offer
+// that is registered.
+func TestRegistryNegotiateServerSkipsUnregisteredOffers(t *testing.T) {
+	var reg compressionExtensionRegistry
+	reg.register(&fakeExtension{name: "permessage-deflate"})
+
+	accept, ext := reg.negotiateServer([]string{"permessage-zstd", "permessage-deflate"})
+	if ext == nil {
+		t.Fatalf("negotiateServer returned nil ext")
+	}
+	if accept != "permessage-deflate" {
+		t.Fatalf("accept = %q, want %q", accept, "permessage-deflate")
+	}
+}
+
+// TestRegistryEnsureDefault checks that ensureDefault installs the fallback
+// extension only once: a second call leaves the registry as it is.
+func TestRegistryEnsureDefault(t *testing.T) {
+	var reg compressionExtensionRegistry
+	reg.ensureDefault(&fakeExtension{name: "default"})
+	reg.ensureDefault(&fakeExtension{name: "should-not-apply"})
+
+	list := reg.list()
+	if len(list) != 1 || list[0].Name() != "default" {
+		t.Fatalf("list = %v, want a single \"default\" extension", list)
+	}
+}
+
+// TestNegotiateClientOffersContextTakeoverAndWindowBits checks that a
+// Dialer-side permessageDeflateExtension's offer reflects enableContextTakeover
+// and serverMaxWindowBits, and never offers clientMaxWindowBits (which it
+// cannot honor on its own writer).
+func TestNegotiateClientOffersContextTakeoverAndWindowBits(t *testing.T) {
+	declining := &permessageDeflateExtension{}
+	if offer := declining.NegotiateClient(); offer != "permessage-deflate; client_no_context_takeover; server_no_context_takeover" {
+		t.Fatalf("declining offer = %q", offer)
+	}
+
+	e := &permessageDeflateExtension{
+		enableContextTakeover: true,
+		clientMaxWindowBits:   10,
+		serverMaxWindowBits:   10,
+	}
+	offer := e.NegotiateClient()
+	if offer != "permessage-deflate; server_max_window_bits=10" {
+		t.Fatalf("offer = %q, want context takeover offered and only server_max_window_bits sent", offer)
+	}
+}
+
+// TestNegotiateServerRequestsClientWindowBitsWithoutOffer checks that an
+// Upgrader-side permessageDeflateExtension configured with ClientMaxWindowBits
+// proactively includes client_max_window_bits in its accept per RFC 7692
+// 7.1.2.2, even when the client's offer didn't include one, and that it
+// tightens (rather than loosens) a value the client did offer.
+func TestNegotiateServerRequestsClientWindowBitsWithoutOffer(t *testing.T) {
+	e := &permessageDeflateExtension{isServer: true, enableContextTakeover: true, clientMaxWindowBits: 10}
+
+	accept, _, err := e.NegotiateServer("permessage-deflate")
+	if err != nil {
+		t.Fatalf("NegotiateServer: %v", err)
+	}
+	if accept != "permessage-deflate; client_max_window_bits=10" {
+		t.Fatalf("accept = %q, want a proactive client_max_window_bits=10", accept)
+	}
+
+	accept, _, err = e.NegotiateServer("permessage-deflate; client_max_window_bits=15")
+	if err != nil {
+		t.Fatalf("NegotiateServer: %v", err)
+	}
+	if accept != "permessage-deflate; client_max_window_bits=10" {
+		t.Fatalf("accept = %q, want the tighter configured bound to win", accept)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// writeContextTakeover compresses message through a context-takeover writer factory and
+// returns the framed (tail-included) compressed bytes for one message.
+func writeContextTakeover(t *testing.T, f *contextTakeoverWriterFactory, message string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := f.newCompressionWriter(nopCloser{&buf}, defaultCompressionLevel)
+	if _, err := w.Write([]byte(message)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+type nopCloser struct {
+	w io.Writer
+}
+
+func (n nopCloser) Write(p []byte) (int, error) { return n.w.Write(p) }
+func (nopCloser) Close() error                  { return nil }
+
+// TestContextTakeoverRoundTrip checks that a writer factory's LZ77 context
+// (and a reader factory whose dictionary is capped to minWindowBits)
+// lets a later message reference bytes from an earlier one on the same
+// connection, and that the reader's dictionary stays within that window.
+func TestContextTakeoverRoundTrip(t *testing.T) {
+	writerFactory := &contextTakeoverWriterFactory{}
+	readerFactory := &contextTakeoverReaderFactory{
+		fr:         flateReaderPool.Get().(io.ReadCloser),
+		windowBits: minWindowBits,
+	}
+
+	messages := []string{
+		"the quick brown fox jumps over the lazy dog",
+		"the quick brown fox jumps over the lazy dog again",
+	}
+
+	for _, message := range messages {
+		compressed := writeContextTakeover(t, writerFactory, message)
+
+		r := readerFactory.newDeCompressionReader(bytes.NewReader(compressed))
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		if string(got) != message {
+			t.Fatalf("got %q, want %q", got, message)
+		}
+	}
+
+	if max := 1 << minWindowBits; len(readerFactory.window) > max {
+		t.Fatalf("reader window grew to %d bytes, want <= %d", len(readerFactory.window), max)
+	}
+}
+
+// TestDecompressLimiterSize checks that checkOutput trips
+// ErrDecompressedMessageTooLarge once the decompressed byte count for a
+// message exceeds maxSize, and that reset lets a later message succeed.
+func TestDecompressLimiterSize(t *testing.T) {
+	l := &decompressLimiter{maxSize: 10}
+
+	if err := l.checkOutput(5); err != nil {
+		t.Fatalf("checkOutput(5): %v", err)
+	}
+	err := l.checkOutput(10)
+	if !errors.Is(err, ErrDecompressedMessageTooLarge) {
+		t.Fatalf("checkOutput(10): got %v, want ErrDecompressedMessageTooLarge", err)
+	}
+
+	l.reset()
+	if err := l.checkOutput(10); err != nil {
+		t.Fatalf("checkOutput after reset: %v", err)
+	}
+}
+
+// TestDecompressLimiterRatio checks that checkOutput trips
+// ErrDecompressedMessageTooLarge once the decompressed/compressed ratio for
+// a message exceeds maxRatio.
+func TestDecompressLimiterRatio(t *testing.T) {
+	l := &decompressLimiter{maxRatio: 2}
+	l.in = 10
+
+	if err := l.checkOutput(15); err != nil {
+		t.Fatalf("checkOutput(15): %v", err)
+	}
+	err := l.checkOutput(10) // out is now 25, ratio 2.5 > 2
+	if !errors.Is(err, ErrDecompressedMessageTooLarge) {
+		t.Fatalf("checkOutput(10): got %v, want ErrDecompressedMessageTooLarge", err)
+	}
+}
+
+// TestDecompressNoContextTakeoverSizeLimit checks that
+// decompressNoContextTakeover's reader enforces maxSize against real
+// compressed input.
+func TestDecompressNoContextTakeoverSizeLimit(t *testing.T) {
+	var compressed bytes.Buffer
+	w := compressNoContextTakeover(nopCloser{&compressed}, defaultCompressionLevel)
+	message := bytes.Repeat([]byte("a"), 1000)
+	if _, err := w.Write(message); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r := decompressNoContextTakeover(bytes.NewReader(compressed.Bytes()), 100, 0)
+	_, err := io.ReadAll(r)
+	if !errors.Is(err, ErrDecompressedMessageTooLarge) {
+		t.Fatalf("ReadAll: got %v, want ErrDecompressedMessageTooLarge", err)
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Close codes defined in RFC 6455, section 11.7.
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+	CloseServiceRestart          = 1012
+	CloseTryAgainLater           = 1013
+	CloseTLSHandshake            = 1015
+)
+
+// Message types as defined in RFC 6455, section 11.8.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+)
+
+const finBit = 1 << 7
+const rsv1Bit = 1 << 6
+
+var errWriteClosed = errors.New("websocket: write to closed writer")
+
+// ErrReadLimitExceeded is returned by NextReader/ReadMessage when a frame's
+// payload length, read off the wire before any decompression, exceeds the
+// Conn's read limit. Unlike ErrDecompressedMessageTooLarge, this is checked
+// against the raw (possibly still-compressed) frame length, so it bounds
+// memory use even against a peer that never sends a single compressed byte.
+var ErrReadLimitExceeded = errors.New("websocket: frame payload exceeds read limit")
+
+// CloseError is returned by NextReader/ReadMessage when the peer sends a
+// close frame.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return "websocket: close " + strconv.Itoa(e.Code) + " " + e.Text
+}
+
+// Conn represents an RFC 6455 WebSocket connection. This implementation
+// covers whole, unfragmented messages (no continuation frames) and ping,
+// pong and close control frames, which is what's needed to exercise a
+// negotiated CompressionExtension end to end; it does not attempt full
+// RFC 6455 compliance (fragmentation, UTF-8 validation of text frames,
+// deadlines, and so on).
+type Conn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	isServer bool
+
+	// extension is the ConnExtension negotiated during the handshake by
+	// Upgrader.Upgrade or Dialer.Dial, or nil if none was negotiated.
+	extension ConnExtension
+
+	// readLimit bounds a single frame's raw payload length, read off the
+	// wire before any decompression; 0 means unlimited. See SetReadLimit.
+	readLimit int64
+
+	writeMu sync.Mutex
+}
+
+func newConn(netConn net.Conn, isServer bool, br *bufio.Reader, extension ConnExtension, readLimit int64) *Conn {
+	if br == nil {
+		br = bufio.NewReader(netConn)
+	}
+	return &Conn{conn: netConn, br: br, isServer: isServer, extension: extension, readLimit: readLimit}
+}
+
+// SetReadLimit sets the maximum size, in bytes, of a single frame's raw
+// payload that NextReader/ReadMessage will allocate for; 0 means unlimited.
+// It bounds memory use independently of any negotiated CompressionExtension,
+// since it is enforced before the payload is decompressed.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// Close closes the underlying network connection without sending a close
+// frame.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// NextWriter returns a writer for the next message to send. The message is
+// buffered in memory and framed as a single WebSocket frame, compressed
+// through the negotiated extension if one was negotiated, when Close is
+// called.
+func (c *Conn) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &messageWriter{c: c, messageType: messageType}, nil
+}
+
+// WriteMessage is a helper for writing a single message in one call.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	w, err := c.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+type messageWriter struct {
+	c           *Conn
+	messageType int
+	buf         bytes.Buffer
+	closed      bool
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errWriteClosed
+	}
+	return w.buf.Write(p)
+}
+
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return errWriteClosed
+	}
+	w.closed = true
+
+	payload := w.buf.Bytes()
+	rsv1 := false
+	if w.c.extension != nil {
+		var compressed bytes.Buffer
+		cw := w.c.extension.NewWriter(nopWriteCloser{&compressed})
+		if _, err := cw.Write(payload); err != nil {
+			return err
+		}
+		if err := cw.Close(); err != nil {
+			return err
+		}
+		payload = compressed.Bytes()
+		rsv1 = true
+	}
+
+	return w.c.writeFrame(byte(w.messageType), rsv1, payload)
+}
+
+// nopWriteCloser adapts a *bytes.Buffer to io.WriteCloser for use as the
+// destination of a ConnExtension writer, which always Closes its
+// destination exactly once per message.
+type nopWriteCloser struct {
+	w *bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (n nopWriteCloser) Write(p []byte) (int, error) { return n.w.Write(p) }
+
+// writeFrame writes a single, final (FIN-set) frame with the given opcode,
+// RSV1 bit and payload, masking it if this Conn is the client side of the
+// connection, per RFC 6455 section 5.2.
+func (c *Conn) writeFrame(opcode byte, rsv1 bool, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	b0 := finBit | opcode
+	if rsv1 {
+		b0 |= rsv1Bit
+	}
+
+	maskBit := byte(0)
+	if !c.isServer {
+		maskBit = 1 << 7
+	}
+
+	var header [10]byte
+	header[0] = b0
+	n := 1
+
+	switch {
+	case len(payload) <= 125:
+		header[1] = maskBit | byte(len(payload))
+		n++
+	case len(payload) <= 65535:
+		header[1] = maskBit | 126
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(payload)))
+		n += 3
+	default:
+		header[1] = maskBit | 127
+		binary.BigEndian.PutUint64(header[2:10], uint64(len(payload)))
+		n += 9
+	}
+
+	if _, err := c.conn.Write(header[:n]); err != nil {
+		return err
+	}
+
+	if !c.isServer {
+		var maskKey [4]byte
+		if _, err := io.ReadFull(rand.Reader, maskKey[:]); err != nil {
+			return err
+		}
+		if _, err := c.conn.Write(maskKey[:]); err != nil {
+			return err
+		}
+		masked := make([]byte, len(payload))
+		for i, b := range payload {
+			masked[i] = b ^ maskKey[i%4]
+		}
+		payload = masked
+	}
+
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// writeClose sends a close frame with the given status code and reason.
+func (c *Conn) writeClose(code int, text string) error {
+	payload := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(payload[:2], uint16(code))
+	copy(payload[2:], text)
+	return c.writeFrame(CloseMessage, false, payload)
+}
+
+// readFrame reads a single frame's header and payload, unmasking the
+// payload if it was masked.
+func (c *Conn) readFrame() (fin bool, rsv1 bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.br, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&finBit != 0
+	rsv1 = header[0]&rsv1Bit != 0
+	opcode = header[0] & 0xf
+
+	masked := header[1]&(1<<7) != 0
+	length := int64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	// A 64-bit extended length with the high bit set becomes negative once
+	// cast to int64; reject that, and anything past the configured limit,
+	// before allocating payload below.
+	if length < 0 {
+		err = errors.New("websocket: invalid frame payload length")
+		return
+	}
+	if c.readLimit > 0 && length > c.readLimit {
+		err = ErrReadLimitExceeded
+		return
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, maskKey[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= maskKey[i%4]
+		}
+	}
+	return
+}
+
+// NextReader reads the next WebSocket message and returns its message type
+// and a reader for its payload. If the frame's RSV1 bit is set, the payload
+// is decompressed through the negotiated ConnExtension before being
+// returned; if decompression fails with ErrDecompressedMessageTooLarge, or
+// the frame's raw payload length exceeds SetReadLimit (ErrReadLimitExceeded),
+// a close frame with status code CloseMessageTooBig is sent before the
+// error is returned, so the peer learns why the connection is ending (RFC
+// 7692 section 7.2.3, RFC 6455 section 11.7).
+func (c *Conn) NextReader() (messageType int, r io.Reader, err error) {
+	fin, rsv1, opcode, payload, err := c.readFrame()
+	if err != nil {
+		if errors.Is(err, ErrReadLimitExceeded) {
+			_ = c.writeClose(CloseMessageTooBig, err.Error())
+		}
+		return 0, nil, err
+	}
+	if !fin {
+		return 0, nil, errors.New("websocket: fragmented messages are not supported")
+	}
+	if opcode == CloseMessage {
+		return 0, nil, c.closeFrameError(payload)
+	}
+
+	if !rsv1 {
+		return int(opcode), bytes.NewReader(payload), nil
+	}
+	if c.extension == nil {
+		return 0, nil, errors.New("websocket: received a compressed frame but no compression extension was negotiated")
+	}
+
+	rc := c.extension.NewReader(bytes.NewReader(payload))
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		if errors.Is(err, ErrDecompressedMessageTooLarge) {
+			_ = c.writeClose(CloseMessageTooBig, err.Error())
+		}
+		return 0, nil, err
+	}
+
+	return int(opcode), bytes.NewReader(data), nil
+}
+
+// ReadMessage is a helper for reading a single message in one call.
+func (c *Conn) ReadMessage() (messageType int, p []byte, err error) {
+	messageType, r, err := c.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+	p, err = io.ReadAll(r)
+	return messageType, p, err
+}
+
+func (c *Conn) closeFrameError(payload []byte) error {
+	code := CloseNoStatusReceived
+	text := ""
+	if len(payload) >= 2 {
+		code = int(binary.BigEndian.Uint16(payload[:2]))
+		text = string(payload[2:])
+	}
+	return &CloseError{Code: code, Text: text}
+}
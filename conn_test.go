@@ -0,0 +1,186 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// TestConnTranslatesDecompressionBombToClose checks that when NextReader's
+// decompression of a message trips ErrDecompressedMessageTooLarge, the
+// connection sends a real close frame with status code CloseMessageTooBig
+// instead of silently dropping the message.
+func TestConnTranslatesDecompressionBombToClose(t *testing.T) {
+	serverNetConn, clientNetConn := net.Pipe()
+	defer serverNetConn.Close()
+	defer clientNetConn.Close()
+
+	serverConn := newConn(serverNetConn, true, nil, &deflateConnExtension{maxDecompressedMessageSize: 10}, 0)
+	clientConn := newConn(clientNetConn, false, nil, nil, 0)
+
+	var compressed bytes.Buffer
+	w := compressNoContextTakeover(nopCloser{&compressed}, defaultCompressionLevel)
+	if _, err := w.Write(bytes.Repeat([]byte("a"), 1000)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Both of these run concurrently with the NextReader call below: the
+	// server's read of the oversized message and its write of the close
+	// frame it provokes happen inside that single NextReader call, over
+	// the same net.Pipe, so something must be reading/writing the other
+	// end the whole time or everyone blocks forever.
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- clientConn.writeFrame(BinaryMessage, true, compressed.Bytes())
+	}()
+
+	type closeFrame struct {
+		fin     bool
+		opcode  byte
+		payload []byte
+		err     error
+	}
+	closeFrameCh := make(chan closeFrame, 1)
+	go func() {
+		fin, _, opcode, payload, err := clientConn.readFrame()
+		closeFrameCh <- closeFrame{fin, opcode, payload, err}
+	}()
+
+	if _, _, err := serverConn.NextReader(); !errors.Is(err, ErrDecompressedMessageTooLarge) {
+		t.Fatalf("NextReader: got %v, want ErrDecompressedMessageTooLarge", err)
+	}
+
+	if err := <-writeErr; err != nil {
+		t.Fatalf("client writeFrame: %v", err)
+	}
+
+	got := <-closeFrameCh
+	if got.err != nil {
+		t.Fatalf("readFrame: %v", got.err)
+	}
+	if !got.fin || got.opcode != CloseMessage {
+		t.Fatalf("got fin=%v opcode=%d, want a final close frame", got.fin, got.opcode)
+	}
+	if len(got.payload) < 2 {
+		t.Fatalf("close payload too short: %d bytes", len(got.payload))
+	}
+	if code := int(got.payload[0])<<8 | int(got.payload[1]); code != CloseMessageTooBig {
+		t.Fatalf("close code = %d, want %d", code, CloseMessageTooBig)
+	}
+}
+
+// TestReadFrameRejectsNegativeLength checks that an extended (127) length
+// header with the high bit set, which becomes negative once cast to int64,
+// is rejected with an error instead of panicking in make([]byte, length).
+func TestReadFrameRejectsNegativeLength(t *testing.T) {
+	serverNetConn, clientNetConn := net.Pipe()
+	defer serverNetConn.Close()
+	defer clientNetConn.Close()
+
+	serverConn := newConn(serverNetConn, true, nil, nil, 0)
+
+	header := []byte{finBit | byte(BinaryMessage), 127, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := clientNetConn.Write(header)
+		writeErr <- err
+	}()
+
+	if _, _, _, _, err := serverConn.readFrame(); err == nil {
+		t.Fatalf("readFrame: got nil error, want a rejection of the negative length")
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+}
+
+// TestConnTranslatesReadLimitExceededToClose checks that when a frame's raw
+// payload length exceeds SetReadLimit, NextReader sends a close frame with
+// status code CloseMessageTooBig, the same treatment as
+// ErrDecompressedMessageTooLarge, even though no decompression is involved.
+func TestConnTranslatesReadLimitExceededToClose(t *testing.T) {
+	serverNetConn, clientNetConn := net.Pipe()
+	defer serverNetConn.Close()
+	defer clientNetConn.Close()
+
+	serverConn := newConn(serverNetConn, true, nil, nil, 10)
+	clientConn := newConn(clientNetConn, false, nil, nil, 0)
+
+	// The oversized frame's mask key and payload are never drained, since
+	// serverConn bails out of readFrame right after the header; on this
+	// synchronous net.Pipe that leaves clientConn.writeFrame blocked until
+	// the deferred Close above unblocks it, so its error isn't checked here.
+	go func() {
+		_ = clientConn.writeFrame(BinaryMessage, false, bytes.Repeat([]byte("a"), 1000))
+	}()
+
+	type closeFrame struct {
+		fin     bool
+		opcode  byte
+		payload []byte
+		err     error
+	}
+	closeFrameCh := make(chan closeFrame, 1)
+	go func() {
+		fin, _, opcode, payload, err := clientConn.readFrame()
+		closeFrameCh <- closeFrame{fin, opcode, payload, err}
+	}()
+
+	if _, _, err := serverConn.NextReader(); !errors.Is(err, ErrReadLimitExceeded) {
+		t.Fatalf("NextReader: got %v, want ErrReadLimitExceeded", err)
+	}
+
+	got := <-closeFrameCh
+	if got.err != nil {
+		t.Fatalf("readFrame: %v", got.err)
+	}
+	if !got.fin || got.opcode != CloseMessage {
+		t.Fatalf("got fin=%v opcode=%d, want a final close frame", got.fin, got.opcode)
+	}
+	if len(got.payload) < 2 {
+		t.Fatalf("close payload too short: %d bytes", len(got.payload))
+	}
+	if code := int(binary.BigEndian.Uint16(got.payload[:2])); code != CloseMessageTooBig {
+		t.Fatalf("close code = %d, want %d", code, CloseMessageTooBig)
+	}
+}
+
+// TestConnWriteMessageReadMessage checks a basic uncompressed round trip
+// through the message framing, as a sanity check that NextWriter/NextReader
+// agree on frame format.
+func TestConnWriteMessageReadMessage(t *testing.T) {
+	serverNetConn, clientNetConn := net.Pipe()
+	defer serverNetConn.Close()
+	defer clientNetConn.Close()
+
+	serverConn := newConn(serverNetConn, true, nil, nil, 0)
+	clientConn := newConn(clientNetConn, false, nil, nil, 0)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- clientConn.WriteMessage(TextMessage, []byte("hello"))
+	}()
+
+	messageType, data, err := serverConn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	if messageType != TextMessage {
+		t.Fatalf("messageType = %d, want %d", messageType, TextMessage)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("data = %q, want %q", data, "hello")
+	}
+}
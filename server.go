@@ -0,0 +1,160 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Upgrader upgrades an HTTP connection to a WebSocket connection, optionally
+// negotiating a CompressionExtension offered by the client.
+type Upgrader struct {
+	// EnableCompression specifies whether the server should attempt to
+	// negotiate a CompressionExtension offered in the client's
+	// Sec-WebSocket-Extensions header. It defaults to false.
+	EnableCompression bool
+
+	// EnableContextTakeover specifies whether the server is willing to
+	// negotiate permessage-deflate context takeover (retaining the LZ77
+	// dictionary across messages) in either direction. It defaults to
+	// false, which declines context takeover regardless of what the client
+	// offers.
+	EnableContextTakeover bool
+
+	// ClientMaxWindowBits, if in the range 8-15, caps the LZ77 window the
+	// client's writer may use; the server's reader enforces this bound, so
+	// it is included in the accept even if the client didn't offer a
+	// client_max_window_bits value of its own (RFC 7692 7.1.2.2). 0 leaves
+	// the client's window uncapped.
+	ClientMaxWindowBits int
+
+	// ServerMaxWindowBits has no effect: it would cap the server's own
+	// writer window, which compress/flate cannot actually restrict, so a
+	// server_max_window_bits value in the client's offer is never echoed
+	// back in the accept. It exists so Upgrader's negotiation fields mirror
+	// Dialer's.
+	ServerMaxWindowBits int
+
+	// MaxDecompressedMessageSize bounds the decompressed size of a single
+	// message on a connection that negotiated a CompressionExtension; 0
+	// means unlimited. See ErrDecompressedMessageTooLarge.
+	MaxDecompressedMessageSize int64
+
+	// MaxCompressionRatio bounds decompressed-size / compressed-size for a
+	// single message; 0 means unlimited.
+	MaxCompressionRatio float64
+
+	// ReadLimit bounds a single frame's raw payload length, read off the
+	// wire before any decompression; 0 means unlimited. See
+	// Conn.SetReadLimit.
+	ReadLimit int64
+
+	extensions compressionExtensionRegistry
+}
+
+// RegisterCompressionExtension installs ext so it can be negotiated on
+// connections this Upgrader upgrades, in addition to the default
+// permessage-deflate. Extensions are tried in the order registered, and for
+// each of the client's offers (tried in the order the client sent them) the
+// first registered extension whose Name matches wins.
+func (u *Upgrader) RegisterCompressionExtension(ext CompressionExtension) {
+	u.extensions.register(ext)
+}
+
+// negotiateExtensions parses the client's Sec-WebSocket-Extensions header
+// and returns the accept string for the 101 response and the ConnExtension
+// to use for the connection, or "", nil if compression is disabled or no
+// offer could be negotiated.
+func (u *Upgrader) negotiateExtensions(header string) (string, ConnExtension) {
+	if !u.EnableCompression || header == "" {
+		return "", nil
+	}
+	u.extensions.ensureDefault(&permessageDeflateExtension{
+		level:                      defaultCompressionLevel,
+		isServer:                   true,
+		enableContextTakeover:      u.EnableContextTakeover,
+		clientMaxWindowBits:        u.ClientMaxWindowBits,
+		serverMaxWindowBits:        u.ServerMaxWindowBits,
+		maxDecompressedMessageSize: u.MaxDecompressedMessageSize,
+		maxCompressionRatio:        u.MaxCompressionRatio,
+	})
+	return u.extensions.negotiateServer(splitExtensionOffers(header))
+}
+
+// splitExtensionOffers splits a Sec-WebSocket-Extensions header value into
+// its comma-separated, top-level extension offers, each of which may itself
+// carry semicolon-separated parameters.
+func splitExtensionOffers(header string) []string {
+	parts := strings.Split(header, ",")
+	offers := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			offers = append(offers, p)
+		}
+	}
+	return offers
+}
+
+// Upgrade upgrades r's HTTP connection to the WebSocket protocol by
+// hijacking the underlying net.Conn and writing the 101 response.
+// responseHeader, if non-nil, is merged into that response.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*Conn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("websocket: not a websocket handshake")
+	}
+
+	challengeKey := r.Header.Get("Sec-WebSocket-Key")
+	if challengeKey == "" {
+		return nil, errors.New("websocket: missing Sec-WebSocket-Key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("websocket: response does not support hijacking")
+	}
+	netConn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	accept, extension := u.negotiateExtensions(r.Header.Get("Sec-WebSocket-Extensions"))
+
+	var buf strings.Builder
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	buf.WriteString("Upgrade: websocket\r\n")
+	buf.WriteString("Connection: Upgrade\r\n")
+	buf.WriteString("Sec-WebSocket-Accept: " + acceptKey(challengeKey) + "\r\n")
+	if accept != "" {
+		buf.WriteString("Sec-WebSocket-Extensions: " + accept + "\r\n")
+	}
+	for k, vs := range responseHeader {
+		for _, v := range vs {
+			buf.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+
+	if _, err := netConn.Write([]byte(buf.String())); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	return newConn(netConn, true, brw.Reader, extension, u.ReadLimit), nil
+}
+
+// acceptKey computes the Sec-WebSocket-Accept value for challengeKey, per
+// RFC 6455 section 1.3.
+func acceptKey(challengeKey string) string {
+	h := sha1.New()
+	h.Write([]byte(challengeKey))
+	h.Write([]byte(websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}